@@ -0,0 +1,123 @@
+package runcmd
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+// PTYOptions describes the pseudo-terminal requested for a command started
+// via CommandWithPTY.
+type PTYOptions struct {
+	Term  string
+	Rows  uint32
+	Cols  uint32
+	Modes ssh.TerminalModes
+}
+
+func (this PTYOptions) withDefaults() PTYOptions {
+	if this.Term == "" {
+		this.Term = "xterm-256color"
+	}
+	if this.Rows == 0 {
+		this.Rows = 24
+	}
+	if this.Cols == 0 {
+		this.Cols = 80
+	}
+	if this.Modes == nil {
+		this.Modes = ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+	}
+	return this
+}
+
+// CommandWithPTY is like Command, but requests a pseudo-terminal for the
+// session (wsmv has no equivalent; this only applies to Remote and Local).
+// Use the returned CmdWorker's WindowChange to notify the remote pty of
+// terminal resizes (SIGWINCH).
+func (this *Remote) CommandWithPTY(cmd string, opts PTYOptions) (CmdWorker, error) {
+	if cmd == "" {
+		return nil, errors.New("command cannot be empty")
+	}
+	opts = opts.withDefaults()
+
+	s, err := this.serverConn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.RequestPty(opts.Term, int(opts.Rows), int(opts.Cols), opts.Modes); err != nil {
+		s.Close()
+		return nil, err
+	}
+	stdinPipe, err := s.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutPipe, err := s.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrPipe, err := s.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteCmd{
+		stdinPipe,
+		stdoutPipe,
+		stderrPipe,
+		cmd,
+		s,
+		nil,
+		make(chan struct{}),
+		true,
+	}, nil
+}
+
+// CommandWithPTY is like Command, but runs the child process attached to a
+// pseudo-terminal (via github.com/creack/pty) instead of plain pipes, so
+// interactive/TTY-only programs (top, vim, sudo prompts) behave normally.
+// The pty only has a single combined stdout+stderr stream, so StdoutPipe
+// carries it and StderrPipe reads as already-EOF - giving Run/RunStream two
+// readers on the same *os.File would race two bufio.Scanners against each
+// other and, once the child hangs up the slave side, surface the pty's EIO
+// as a spurious error from the second reader.
+func (this *Local) CommandWithPTY(cmd string, opts PTYOptions) (CmdWorker, error) {
+	if cmd == "" {
+		return nil, errors.New("command cannot be empty")
+	}
+	opts = opts.withDefaults()
+
+	c := exec.Command(strings.Fields(cmd)[0], strings.Fields(cmd)[1:]...)
+
+	ptmx, pts, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err := pty.Setsize(ptmx, &pty.Winsize{Rows: uint16(opts.Rows), Cols: uint16(opts.Cols)}); err != nil {
+		ptmx.Close()
+		pts.Close()
+		return nil, err
+	}
+	c.Stdin = pts
+	c.Stdout = pts
+	c.Stderr = pts
+	c.SysProcAttr = &syscall.SysProcAttr{Setctty: true, Setsid: true}
+
+	return &LocalCmd{
+		ptmx,
+		ptmx,
+		io.MultiReader(), // always-EOF stand-in: stderr has no pty stream of its own
+		c,
+		ptmx,
+		pts,
+	}, nil
+}
@@ -0,0 +1,123 @@
+package runcmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// RemoteConfig composes the pieces NewRemoteKeyAuthRunner and
+// NewRemotePassAuthRunner hard-code into a single dial - multiple auth
+// methods, host-key verification, and an optional bastion to tunnel
+// through. Build one with the *Auth and host-key callback helpers below and
+// pass it to NewRemoteFromConfig.
+type RemoteConfig struct {
+	User            string
+	Host            string
+	Auth            []ssh.AuthMethod
+	HostKeyCallback ssh.HostKeyCallback
+
+	// ProxyJump, if set, is used to dial Host from inside an already
+	// established connection (a bastion/jump host) instead of dialing
+	// it directly.
+	ProxyJump *Remote
+}
+
+// PasswordAuth returns an ssh.AuthMethod that authenticates with a plain
+// password.
+func PasswordAuth(password string) ssh.AuthMethod {
+	return ssh.Password(password)
+}
+
+// KeyAuth returns an ssh.AuthMethod that authenticates with the unencrypted
+// private key at keyPath.
+func KeyAuth(keyPath string) (ssh.AuthMethod, error) {
+	bs, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(bs)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// KeyAuthWithPassphrase is like KeyAuth but for a private key encrypted
+// with passphrase.
+func KeyAuthWithPassphrase(keyPath, passphrase string) (ssh.AuthMethod, error) {
+	bs, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(bs, []byte(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// AgentAuth returns an ssh.AuthMethod backed by the keys held in the
+// ssh-agent listening on $SSH_AUTH_SOCK.
+func AgentAuth() (ssh.AuthMethod, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("runcmd: SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	agentClient := agent.NewClient(conn)
+	return ssh.PublicKeysCallback(agentClient.Signers), nil
+}
+
+// KnownHostsCallback returns an ssh.HostKeyCallback that verifies server
+// host keys against the given known_hosts file(s), in OpenSSH format.
+func KnownHostsCallback(files ...string) (ssh.HostKeyCallback, error) {
+	return knownhosts.New(files...)
+}
+
+// InsecureIgnoreHostKey returns an ssh.HostKeyCallback that accepts any
+// host key. It exists so that skipping host-key verification is always an
+// explicit opt-in, never a default.
+func InsecureIgnoreHostKey() ssh.HostKeyCallback {
+	return ssh.InsecureIgnoreHostKey()
+}
+
+// NewRemoteFromConfig dials cfg.Host (directly, or through cfg.ProxyJump if
+// set) with the auth methods and host-key callback in cfg.
+func NewRemoteFromConfig(cfg RemoteConfig) (*Remote, error) {
+	if cfg.HostKeyCallback == nil {
+		return nil, errors.New("runcmd: RemoteConfig.HostKeyCallback is required; use InsecureIgnoreHostKey() to opt out explicitly")
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            cfg.Auth,
+		HostKeyCallback: cfg.HostKeyCallback,
+	}
+
+	if cfg.ProxyJump == nil {
+		server, err := ssh.Dial("tcp", cfg.Host, clientConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &Remote{serverConn: server}, nil
+	}
+
+	conn, err := cfg.ProxyJump.serverConn.Dial("tcp", cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, cfg.Host, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Remote{serverConn: ssh.NewClient(clientConn, chans, reqs)}, nil
+}
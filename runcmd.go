@@ -1,27 +1,124 @@
 package runcmd
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
-	"code.google.com/p/go.crypto/ssh"
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshTerminateGrace is how long RemoteCmd waits after sending SIGTERM on
+// context cancellation before following up with SIGKILL.
+const sshTerminateGrace = 5 * time.Second
+
+// DefaultKeepaliveInterval and DefaultKeepaliveMaxMissed are the defaults
+// used by Remote.Keepalive when a caller doesn't have an opinion.
+const (
+	DefaultKeepaliveInterval  = 2 * time.Second
+	DefaultKeepaliveMaxMissed = 60 // 60 * 2s = 120s before the connection is declared dead
 )
 
 type Runner interface {
 	Command(cmd string) (CmdWorker, error)
+	CommandContext(ctx context.Context, cmd string) (CmdWorker, error)
+
+	// CommandArgv takes a pre-split argument vector instead of a single
+	// string, so arguments containing spaces, quotes, or shell
+	// metacharacters aren't mangled the way naive strings.Fields splitting
+	// of Command's cmd would mangle them.
+	CommandArgv(argv []string) (CmdWorker, error)
 }
 
 type CmdWorker interface {
 	Run() ([]string, error)
+	RunStream(handler func(stream Stream, line string)) error
 	Start() error
 	Wait() error
 	StdinPipe() io.WriteCloser
 	StdoutPipe() io.Reader
 	StderrPipe() io.Reader
+	WindowChange(rows, cols int) error
+}
+
+// Stream identifies which pipe a line delivered to a RunStream handler came
+// from.
+type Stream int
+
+const (
+	Stdout Stream = iota
+	Stderr
+)
+
+func (this Stream) String() string {
+	if this == Stderr {
+		return "stderr"
+	}
+	return "stdout"
+}
+
+// runStream drives worker's stdout and stderr concurrently via
+// bufio.Scanner, delivering each line to handler tagged with its source
+// stream as soon as it arrives, instead of buffering either pipe whole -
+// reading stdout and stderr serially deadlocks on commands that write a lot
+// to the one read second.
+func runStream(worker CmdWorker, handler func(stream Stream, line string)) error {
+	if err := worker.Start(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go scanStream(worker.StdoutPipe(), Stdout, handler, &wg)
+	go scanStream(worker.StderrPipe(), Stderr, handler, &wg)
+	wg.Wait()
+
+	return worker.Wait()
+}
+
+func scanStream(r io.Reader, stream Stream, handler func(stream Stream, line string), wg *sync.WaitGroup) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		handler(stream, scanner.Text())
+	}
+}
+
+// collectLines runs worker via RunStream and gathers its output so Run can
+// build its legacy ([]string, error) return value on top of it. stdout and
+// stderr are collected into separate slices - each one in the deterministic
+// order its own stream produced it in - then joined stdout-then-stderr, so
+// Run keeps returning output in the same fixed order it always has, even
+// though RunStream itself delivers lines interleaved in true arrival order.
+func collectLines(worker CmdWorker) ([]string, error) {
+	var mu sync.Mutex
+	outLines := make([]string, 0)
+	var errLines []string
+
+	runErr := worker.RunStream(func(stream Stream, line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if stream == Stderr {
+			errLines = append(errLines, line)
+		} else {
+			outLines = append(outLines, line)
+		}
+	})
+	if runErr != nil {
+		if len(errLines) > 0 {
+			return nil, errors.New(runErr.Error() + "\n" + strings.Join(errLines, "\n"))
+		}
+		return nil, runErr
+	}
+	return append(outLines, errLines...), nil
 }
 
 type LocalCmd struct {
@@ -29,6 +126,8 @@ type LocalCmd struct {
 	stdoutPipe io.Reader
 	stderrPipe io.Reader
 	cmd        *exec.Cmd
+	ptmx       *os.File
+	pts        *os.File
 }
 
 type RemoteCmd struct {
@@ -37,20 +136,44 @@ type RemoteCmd struct {
 	stderrPipe io.Reader
 	cmd        string
 	session    *ssh.Session
+	ctx        context.Context
+	done       chan struct{}
+	pty        bool
 }
 
 type Local struct {
 }
 
 type Remote struct {
-	serverConn *ssh.Client
+	serverConn    *ssh.Client
+	keepaliveStop chan struct{}
 }
 
 func (this *Local) Command(cmd string) (CmdWorker, error) {
+	return this.CommandContext(context.Background(), cmd)
+}
+
+// CommandContext is like Command but the child process is started with
+// exec.CommandContext, so cancelling ctx kills it.
+func (this *Local) CommandContext(ctx context.Context, cmd string) (CmdWorker, error) {
 	if cmd == "" {
 		return nil, errors.New("command cannot be empty")
 	}
-	c := exec.Command(strings.Fields(cmd)[0], strings.Fields(cmd)[1:]...)
+	fields := strings.Fields(cmd)
+	return newLocalCmd(exec.CommandContext(ctx, fields[0], fields[1:]...))
+}
+
+// CommandArgv is like Command but takes a pre-split argument vector, so it
+// behaves correctly for arguments containing spaces or shell
+// metacharacters, which Command's strings.Fields splitting would mangle.
+func (this *Local) CommandArgv(argv []string) (CmdWorker, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("command cannot be empty")
+	}
+	return newLocalCmd(exec.Command(argv[0], argv[1:]...))
+}
+
+func newLocalCmd(c *exec.Cmd) (*LocalCmd, error) {
 	stdinPipe, err := c.StdinPipe()
 	if err != nil {
 		return nil, err
@@ -68,10 +191,42 @@ func (this *Local) Command(cmd string) (CmdWorker, error) {
 		stdoutPipe,
 		stderrPipe,
 		c,
+		nil,
+		nil,
 	}, nil
 }
 
 func (this *Remote) Command(cmd string) (CmdWorker, error) {
+	return this.CommandContext(context.Background(), cmd)
+}
+
+// CommandArgv is like Command but takes a pre-split argument vector, which
+// is shell-quoted into a single command string before being handed to the
+// session - there's no argv-based exec over an SSH session, only a command
+// line the remote shell parses - so the result behaves the same as
+// Local.CommandArgv given the same argv.
+func (this *Remote) CommandArgv(argv []string) (CmdWorker, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("command cannot be empty")
+	}
+	return this.CommandContext(context.Background(), shellQuote(argv))
+}
+
+// shellQuote joins argv into a single POSIX shell command line, quoting
+// each argument so spaces and shell metacharacters are passed through
+// literally instead of being re-split or expanded.
+func shellQuote(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// CommandContext is like Command, but if ctx is cancelled before the
+// session finishes, a goroutine sends SIGTERM over the session, waits
+// sshTerminateGrace, then follows up with SIGKILL and closes the session.
+func (this *Remote) CommandContext(ctx context.Context, cmd string) (CmdWorker, error) {
 	if cmd == "" {
 		return nil, errors.New("command cannot be empty")
 	}
@@ -97,41 +252,34 @@ func (this *Remote) Command(cmd string) (CmdWorker, error) {
 		stderrPipe,
 		cmd,
 		s,
+		ctx,
+		make(chan struct{}),
+		false,
 	}, nil
 }
 
 func (this *LocalCmd) Run() ([]string, error) {
-	out := make([]string, 0)
-	if err := this.Start(); err != nil {
-		return nil, err
-	}
-	stdout := this.StdoutPipe()
-	bOut, err := ioutil.ReadAll(stdout)
-	if err != nil {
-		return nil, err
-	}
-	stderr := this.StderrPipe()
-	bErr, err := ioutil.ReadAll(stderr)
-	if err != nil {
-		return nil, err
-	}
-	if err := this.Wait(); err != nil {
-		if len(bErr) > 0 {
-			return nil, errors.New(err.Error() + "\n" + string(bErr))
-		}
-		return nil, err
-	}
-	if len(bOut) > 0 {
-		out = append(out, strings.Split(strings.Trim(string(bOut), "\n"), "\n")...)
-	}
-	if len(bErr) > 0 {
-		out = append(out, strings.Split(strings.Trim(string(bErr), "\n"), "\n")...)
-	}
-	return out, nil
+	return collectLines(this)
+}
+
+// RunStream starts the command and delivers its output to handler line by
+// line as it arrives, tagged with the stream (Stdout/Stderr) it came from.
+// It returns once the command has finished, with the same error Wait would
+// return.
+func (this *LocalCmd) RunStream(handler func(stream Stream, line string)) error {
+	return runStream(this, handler)
 }
 
 func (this *LocalCmd) Start() error {
-	return this.cmd.Start()
+	if err := this.cmd.Start(); err != nil {
+		return err
+	}
+	if this.pts != nil {
+		// The child now owns the slave side of the pty; the parent only
+		// needs the master (this.ptmx) to talk to it.
+		this.pts.Close()
+	}
+	return nil
 }
 
 func (this *LocalCmd) Wait() error {
@@ -170,43 +318,61 @@ func (this *LocalCmd) StderrPipe() io.Reader {
 	return this.stderrPipe
 }
 
-func (this *RemoteCmd) Run() ([]string, error) {
-	defer this.session.Close()
-	out := make([]string, 0)
-	if err := this.Start(); err != nil {
-		return nil, err
-	}
-	stdout := this.StdoutPipe()
-	bOut, err := ioutil.ReadAll(stdout)
-	if err != nil {
-		return nil, err
-	}
-	stderr := this.StderrPipe()
-	bErr, err := ioutil.ReadAll(stderr)
-	if err != nil {
-		return nil, err
-	}
-	if err := this.Wait(); err != nil {
-		if len(bErr) > 0 {
-			return nil, errors.New(err.Error() + "\n" + string(bErr))
-		}
-		return nil, err
+// WindowChange resizes the pseudo-terminal backing this command. It only
+// succeeds for commands started via Local.CommandWithPTY.
+func (this *LocalCmd) WindowChange(rows, cols int) error {
+	if this.ptmx == nil {
+		return errors.New("runcmd: command was not started with a pty")
 	}
-	if len(bOut) > 0 {
-		out = append(out, strings.Split(strings.Trim(string(bOut), "\n"), "\n")...)
+	return pty.Setsize(this.ptmx, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+}
+
+func (this *RemoteCmd) Run() ([]string, error) {
+	return collectLines(this)
+}
+
+// RunStream starts the command and delivers its output to handler line by
+// line as it arrives, tagged with the stream (Stdout/Stderr) it came from.
+// It returns once the command has finished, with the same error Wait would
+// return.
+func (this *RemoteCmd) RunStream(handler func(stream Stream, line string)) error {
+	return runStream(this, handler)
+}
+
+func (this *RemoteCmd) Start() error {
+	if err := this.session.Start(this.cmd); err != nil {
+		return err
 	}
-	if len(bErr) > 0 {
-		out = append(out, strings.Split(strings.Trim(string(bErr), "\n"), "\n")...)
+	if this.ctx != nil {
+		go this.watchContext()
 	}
-	return out, nil
+	return nil
 }
 
-func (this *RemoteCmd) Start() error {
-	return this.session.Start(this.cmd)
+// watchContext waits for either the command to finish (this.done closed by
+// Wait) or this.ctx to be cancelled. On cancellation it asks the remote
+// process to terminate gracefully first, then kills it after the grace
+// period, same as the Terraform SSH communicator does against raw
+// x/crypto/ssh, which has no built-in way to kill a session's process.
+func (this *RemoteCmd) watchContext() {
+	select {
+	case <-this.done:
+		return
+	case <-this.ctx.Done():
+	}
+	this.session.Signal(ssh.SIGTERM)
+	select {
+	case <-this.done:
+		return
+	case <-time.After(sshTerminateGrace):
+	}
+	this.session.Signal(ssh.SIGKILL)
+	this.session.Close()
 }
 
 func (this *RemoteCmd) Wait() error {
 	defer this.session.Close()
+	defer close(this.done)
 	cerr := this.StderrPipe()
 	bErr, err := ioutil.ReadAll(cerr)
 	if err != nil {
@@ -243,6 +409,15 @@ func (this *RemoteCmd) StderrPipe() io.Reader {
 	return this.stderrPipe
 }
 
+// WindowChange notifies the remote pty of a terminal resize. It only
+// succeeds for sessions started via Remote.CommandWithPTY.
+func (this *RemoteCmd) WindowChange(rows, cols int) error {
+	if !this.pty {
+		return errors.New("runcmd: command was not started with a pty")
+	}
+	return this.session.WindowChange(rows, cols)
+}
+
 func NewLocalRunner() (*Local, error) {
 	return &Local{}, nil
 }
@@ -262,26 +437,81 @@ func NewRemoteKeyAuthRunner(user, host, key string) (*Remote, error) {
 	config := &ssh.ClientConfig{
 		User: user,
 		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		// Preserves this constructor's historical behavior of not verifying
+		// the host key. Use NewRemoteFromConfig with a KnownHostsCallback
+		// for a verified connection.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 	server, err := ssh.Dial("tcp", host, config)
 	if err != nil {
 		return nil, err
 	}
-	return &Remote{server}, nil
+	return &Remote{serverConn: server}, nil
 }
 
 func NewRemotePassAuthRunner(user, host, password string) (*Remote, error) {
 	config := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{ssh.Password(password)},
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 	server, err := ssh.Dial("tcp", host, config)
 	if err != nil {
 		return nil, err
 	}
-	return &Remote{server}, nil
+	return &Remote{serverConn: server}, nil
 }
 
 func (this *Remote) CloseConnection() error {
+	this.StopKeepalive()
 	return this.serverConn.Close()
 }
+
+// Keepalive starts a background loop that periodically sends a
+// keepalive@openssh.com global request over the connection, at the given
+// interval, so a dead TCP connection is detected instead of hanging a
+// future Wait() forever - x/crypto/ssh has no keepalive of its own. After
+// maxMissed consecutive failed requests the connection is closed. Pass <= 0
+// for either argument to use DefaultKeepaliveInterval / DefaultKeepaliveMaxMissed.
+func (this *Remote) Keepalive(interval time.Duration, maxMissed int) {
+	if interval <= 0 {
+		interval = DefaultKeepaliveInterval
+	}
+	if maxMissed <= 0 {
+		maxMissed = DefaultKeepaliveMaxMissed
+	}
+	this.StopKeepalive()
+	this.keepaliveStop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		missed := 0
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_, _, err := this.serverConn.SendRequest("keepalive@openssh.com", true, nil)
+				if err != nil {
+					missed++
+				} else {
+					missed = 0
+				}
+				if missed >= maxMissed {
+					this.serverConn.Close()
+					return
+				}
+			}
+		}
+	}(this.keepaliveStop)
+}
+
+// StopKeepalive stops a keepalive loop started by Keepalive. It is a no-op
+// if none is running.
+func (this *Remote) StopKeepalive() {
+	if this.keepaliveStop != nil {
+		close(this.keepaliveStop)
+		this.keepaliveStop = nil
+	}
+}
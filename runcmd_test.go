@@ -0,0 +1,69 @@
+package runcmd
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// fakeWorker is a CmdWorker whose RunStream replays a canned sequence of
+// lines, so collectLines can be exercised without a real Local/Remote/WinRM
+// backend.
+type fakeWorker struct {
+	lines []fakeLine
+	err   error
+}
+
+type fakeLine struct {
+	stream Stream
+	text   string
+}
+
+func (this *fakeWorker) RunStream(handler func(stream Stream, line string)) error {
+	for _, l := range this.lines {
+		handler(l.stream, l.text)
+	}
+	return this.err
+}
+
+func (this *fakeWorker) Run() ([]string, error)           { return collectLines(this) }
+func (this *fakeWorker) Start() error                     { return nil }
+func (this *fakeWorker) Wait() error                      { return nil }
+func (this *fakeWorker) StdinPipe() io.WriteCloser        { return nil }
+func (this *fakeWorker) StdoutPipe() io.Reader            { return nil }
+func (this *fakeWorker) StderrPipe() io.Reader            { return nil }
+func (this *fakeWorker) WindowChange(rows, cols int) error { return nil }
+
+func TestCollectLinesOrdersStdoutBeforeStderr(t *testing.T) {
+	w := &fakeWorker{
+		lines: []fakeLine{
+			{Stderr, "err1"},
+			{Stdout, "out1"},
+			{Stderr, "err2"},
+			{Stdout, "out2"},
+		},
+	}
+	out, err := collectLines(w)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"out1", "out2", "err1", "err2"}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("collectLines() = %v, want %v", out, want)
+	}
+}
+
+func TestCollectLinesErrorIncludesStderr(t *testing.T) {
+	w := &fakeWorker{
+		lines: []fakeLine{{Stderr, "boom"}},
+		err:   errors.New("exit status 1"),
+	}
+	_, err := collectLines(w)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if got, want := err.Error(), "exit status 1\nboom"; got != want {
+		t.Errorf("collectLines() error = %q, want %q", got, want)
+	}
+}
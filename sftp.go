@@ -0,0 +1,97 @@
+package runcmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTP wraps an SFTP subsystem (RFC 4254 "subsystem" request, name "sftp")
+// opened over an existing Remote's SSH connection, so callers can push
+// scripts or config files before running them without shelling out to scp.
+type SFTP struct {
+	client *sftp.Client
+}
+
+// NewSFTP opens a new session on the connection and requests the sftp
+// subsystem over it.
+func (this *Remote) NewSFTP() (*SFTP, error) {
+	client, err := sftp.NewClient(this.serverConn)
+	if err != nil {
+		return nil, err
+	}
+	return &SFTP{client: client}, nil
+}
+
+// Upload copies the local file at localPath to remotePath on the server.
+func (this *SFTP) Upload(localPath, remotePath string) error {
+	local, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	remote, err := this.client.Create(remotePath)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	_, err = io.Copy(remote, local)
+	return err
+}
+
+// Download copies remotePath from the server to the local file at
+// localPath.
+func (this *SFTP) Download(remotePath, localPath string) error {
+	remote, err := this.client.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	local, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	_, err = io.Copy(local, remote)
+	return err
+}
+
+// Walk walks the remote file tree rooted at root, in the same manner as
+// filepath.Walk: fn is called for every entry, and returning
+// filepath.SkipDir from fn skips the rest of the directory it was called
+// for instead of aborting the whole walk.
+func (this *SFTP) Walk(root string, fn filepath.WalkFunc) error {
+	walker := this.client.Walk(root)
+	for walker.Step() {
+		err := fn(walker.Path(), walker.Stat(), walker.Err())
+		if err == filepath.SkipDir {
+			walker.SkipDir()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chmod changes the permissions of the remote file at path.
+func (this *SFTP) Chmod(path string, mode os.FileMode) error {
+	return this.client.Chmod(path, mode)
+}
+
+// Remove deletes the remote file at path.
+func (this *SFTP) Remove(path string) error {
+	return this.client.Remove(path)
+}
+
+// Close closes the underlying SFTP subsystem session.
+func (this *SFTP) Close() error {
+	return this.client.Close()
+}
@@ -0,0 +1,21 @@
+package runcmd
+
+import "testing"
+
+func TestShellQuote(t *testing.T) {
+	cases := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"echo", "hello"}, "'echo' 'hello'"},
+		{[]string{"grep", "foo bar", "file"}, "'grep' 'foo bar' 'file'"},
+		{[]string{"echo", "it's"}, `'echo' 'it'\''s'`},
+		{[]string{"echo", "$(rm -rf /)"}, "'echo' '$(rm -rf /)'"},
+		{[]string{"echo", "`whoami`"}, "'echo' '`whoami`'"},
+	}
+	for _, c := range cases {
+		if got := shellQuote(c.argv); got != c.want {
+			t.Errorf("shellQuote(%q) = %q, want %q", c.argv, got, c.want)
+		}
+	}
+}
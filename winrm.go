@@ -0,0 +1,185 @@
+package runcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/masterzen/winrm"
+)
+
+// WinRM is a Runner that executes commands on a Windows host over
+// WS-Management (wsman / MS-WSMV) instead of SSH.
+type WinRM struct {
+	client *winrm.Client
+}
+
+// WinRMCmd is the CmdWorker produced by WinRM.Command. It mirrors the
+// stdin/stdout/stderr pipe semantics of LocalCmd/RemoteCmd on top of a
+// wsman shell and command pair.
+type WinRMCmd struct {
+	shell    *winrm.Shell
+	cmd      *winrm.Command
+	cmdLine  string
+	cmdArgs  []string
+	finished chan struct{}
+}
+
+// NewWinRMRunner sets up a client for the WinRM endpoint at host:port using
+// HTTP basic auth and returns a Runner that executes commands on that
+// Windows host. No request is sent until a command's shell is created. When
+// https is true the endpoint (and certificate verification) is done over
+// TLS; pass an *winrm.Endpoint through NewWinRMRunnerWithEndpoint instead
+// if a CA bundle or InsecureSkipVerify needs to be configured.
+func NewWinRMRunner(user, password, host string, port int, https bool) (*WinRM, error) {
+	endpoint := winrm.NewEndpoint(host, port, https, false, nil, nil, nil, 0)
+	return NewWinRMRunnerWithEndpoint(user, password, endpoint)
+}
+
+// NewWinRMRunnerWithEndpoint is like NewWinRMRunner but takes a pre-built
+// *winrm.Endpoint, which is how a CA bundle or InsecureSkipVerify is wired
+// in (see winrm.NewEndpoint).
+func NewWinRMRunnerWithEndpoint(user, password string, endpoint *winrm.Endpoint) (*WinRM, error) {
+	client, err := winrm.NewClient(endpoint, user, password)
+	if err != nil {
+		return nil, err
+	}
+	return &WinRM{client}, nil
+}
+
+// Command opens a Shell on the remote host (wsmv:Create) and prepares cmd
+// to be issued against it (wsmv:Command) once Start is called.
+func (this *WinRM) Command(cmd string) (CmdWorker, error) {
+	return this.CommandContext(context.Background(), cmd)
+}
+
+// CommandArgv is like Command but takes a pre-split argument vector. Unlike
+// Remote, wsman shells take a command and arguments separately, so no
+// shell-quoting is needed.
+func (this *WinRM) CommandArgv(argv []string) (CmdWorker, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("command cannot be empty")
+	}
+	shell, err := this.client.CreateShell()
+	if err != nil {
+		return nil, err
+	}
+	return &WinRMCmd{shell: shell, cmdLine: argv[0], cmdArgs: argv[1:], finished: make(chan struct{})}, nil
+}
+
+// CommandContext is like Command, but if ctx is cancelled before the
+// command finishes, the shell is deleted (wsmv:Delete) to stop it - wsman
+// has no remote-signal equivalent of SSH's "signal" request, so deleting
+// the shell is the only way to reliably kill the remote process tree.
+func (this *WinRM) CommandContext(ctx context.Context, cmd string) (CmdWorker, error) {
+	if cmd == "" {
+		return nil, errors.New("command cannot be empty")
+	}
+	shell, err := this.client.CreateShell()
+	if err != nil {
+		return nil, err
+	}
+	w := &WinRMCmd{shell: shell, cmdLine: cmd, finished: make(chan struct{})}
+	if ctx != nil {
+		go func() {
+			select {
+			case <-w.finished:
+				return
+			case <-ctx.Done():
+				shell.Close()
+			}
+		}()
+	}
+	return w, nil
+}
+
+func (this *WinRMCmd) Run() ([]string, error) {
+	return collectLines(this)
+}
+
+// RunStream starts the command and delivers its output to handler line by
+// line as it arrives, tagged with the stream (Stdout/Stderr) it came from.
+func (this *WinRMCmd) RunStream(handler func(stream Stream, line string)) error {
+	return runStream(this, handler)
+}
+
+// Start issues the command against the already-created shell (wsmv:Command
+// followed by the implicit first wsmv:Receive poll loop the winrm package
+// drives internally).
+func (this *WinRMCmd) Start() error {
+	cmd, err := this.shell.Execute(this.cmdLine, this.cmdArgs...)
+	if err != nil {
+		return err
+	}
+	this.cmd = cmd
+	return nil
+}
+
+// Wait polls wsmv:Receive until the command completes, then issues
+// wsmv:Signal (terminate) and wsmv:Delete to tear the shell down and
+// surfaces a non-zero exit code as an error.
+func (this *WinRMCmd) Wait() error {
+	defer this.shell.Close()
+	defer close(this.finished)
+	this.cmd.Wait()
+	exitCode := this.cmd.ExitCode()
+	this.cmd.Close()
+	if exitCode != 0 {
+		return &WinRMExitError{ExitCode: exitCode}
+	}
+	return nil
+}
+
+// errNotStarted is returned by the pre-Start accessors below: unlike
+// LocalCmd/RemoteCmd, a wsman Command (and its pipes) doesn't exist until
+// the underlying wsmv:Command request is sent, which only happens in Start.
+var errNotStarted = errors.New("winrm: command has not been started yet")
+
+func (this *WinRMCmd) StdinPipe() io.WriteCloser {
+	if this.cmd == nil {
+		return errWriteCloser{errNotStarted}
+	}
+	return this.cmd.Stdin
+}
+
+func (this *WinRMCmd) StdoutPipe() io.Reader {
+	if this.cmd == nil {
+		return errReader{errNotStarted}
+	}
+	return this.cmd.Stdout
+}
+
+func (this *WinRMCmd) StderrPipe() io.Reader {
+	if this.cmd == nil {
+		return errReader{errNotStarted}
+	}
+	return this.cmd.Stderr
+}
+
+// errReader and errWriteCloser let the pre-Start pipe accessors return a
+// value that satisfies io.Reader/io.WriteCloser but surfaces err on first
+// use instead of the caller dereferencing a nil *winrm.Command.
+type errReader struct{ err error }
+
+func (this errReader) Read(p []byte) (int, error) { return 0, this.err }
+
+type errWriteCloser struct{ err error }
+
+func (this errWriteCloser) Write(p []byte) (int, error) { return 0, this.err }
+func (this errWriteCloser) Close() error                { return this.err }
+
+// WindowChange is not supported over wsman; WinRM shells have no pty.
+func (this *WinRMCmd) WindowChange(rows, cols int) error {
+	return errors.New("winrm: pty resize is not supported")
+}
+
+// WinRMExitError is returned by WinRMCmd.Wait (and therefore Run) when the
+// remote command completes with a non-zero exit code.
+type WinRMExitError struct {
+	ExitCode int
+}
+
+func (this *WinRMExitError) Error() string {
+	return fmt.Sprintf("winrm: command exited with status %d", this.ExitCode)
+}